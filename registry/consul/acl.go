@@ -0,0 +1,181 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+import (
+	consul "github.com/hashicorp/consul/api"
+	perrors "github.com/pkg/errors"
+)
+
+import (
+	"github.com/apache/dubbo-go/common"
+	"github.com/apache/dubbo-go/common/logger"
+)
+
+const (
+	// aclTokenRegisterParam/aclTokenQueryParam/aclTokenWatchParam let register, query and watch
+	// operations use distinct ACL tokens; each falls back to the main constant.ACL_TOKEN when unset.
+	aclTokenRegisterParam = "acl.token.register"
+	aclTokenQueryParam    = "acl.token.query"
+	aclTokenWatchParam    = "acl.token.watch"
+
+	// aclTokenFileParam, when set, makes the main token hot-reloadable from a file on disk instead
+	// of the static constant.ACL_TOKEN value.
+	aclTokenFileParam = "acl.token-file"
+	// aclTokenRotateIntervalParam is how often (ms) the token provider is polled for a new token.
+	// A value of 0 (the default) disables rotation entirely.
+	aclTokenRotateIntervalParam = "acl.token-rotate-interval"
+
+	aclNamespaceParam       = "acl.namespace"
+	aclPartitionParam       = "acl.partition"
+	aclBootstrapPrefixParam = "acl.bootstrap-prefix"
+)
+
+// TokenProvider supplies the ACL token consulServiceDiscovery authenticates with. Implementations
+// may return a constant value or reach out to an external source (a file, Vault, ...); Init polls
+// it once at startup and, when rotation is enabled, again on every tick via watchTokenRotation.
+type TokenProvider interface {
+	Token() (string, error)
+}
+
+// StaticTokenProvider is a TokenProvider that always returns the same token, matching the previous
+// acl.token behaviour.
+type StaticTokenProvider string
+
+func (s StaticTokenProvider) Token() (string, error) {
+	return string(s), nil
+}
+
+// FileTokenProvider re-reads Path on every call, so an operator can rotate the token by rewriting
+// the file, without restarting the process.
+type FileTokenProvider struct {
+	Path string
+}
+
+func (f *FileTokenProvider) Token() (string, error) {
+	raw, err := os.ReadFile(f.Path)
+	if err != nil {
+		return "", perrors.WithMessage(err, "read acl token file failed: "+f.Path)
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// CallbackTokenProvider adapts an arbitrary function into a TokenProvider, e.g. a Vault lease
+// renewal callback that mints a fresh token on demand.
+type CallbackTokenProvider func() (string, error)
+
+func (c CallbackTokenProvider) Token() (string, error) {
+	return c()
+}
+
+// newTokenProvider builds the TokenProvider configured on registryURL, falling back to a
+// StaticTokenProvider wrapping the already-resolved constant.ACL_TOKEN value.
+func newTokenProvider(registryURL common.URL, staticToken string) TokenProvider {
+	if path := registryURL.GetParam(aclTokenFileParam, ""); path != "" {
+		return &FileTokenProvider{Path: path}
+	}
+	return StaticTokenProvider(staticToken)
+}
+
+// watchTokenRotation polls csd.tokenProvider every interval and, when the resolved token differs
+// from the one consulClient currently authenticates with, rebuilds the client in place and updates
+// the per-operation tokens that were defaulted from it. Existing TTL heartbeat goroutines and service
+// watchers keep running unaffected because they always fetch the client via csd.client() and the
+// per-operation tokens via csd.getRegisterToken()/getQueryToken()/getWatchToken() rather than holding
+// their own reference.
+func (csd *consulServiceDiscovery) watchTokenRotation(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-csd.rootCtx.Done():
+			return
+		case <-ticker.C:
+			token, err := csd.tokenProvider.Token()
+			if err != nil {
+				logger.Warnf("rotate acl token failed, keeping the current one: %v", err)
+				continue
+			}
+
+			csd.clientMu.Lock()
+			unchanged := token == "" || token == csd.Config.Token
+			csd.clientMu.Unlock()
+			if unchanged {
+				continue
+			}
+
+			newConfig := &consul.Config{Address: csd.address, Token: token, Namespace: csd.namespace, Partition: csd.partition}
+			client, err := consul.NewClient(newConfig)
+			if err != nil {
+				logger.Warnf("rebuild consul client after token rotation failed, keeping the current one: %v", err)
+				continue
+			}
+
+			csd.clientMu.Lock()
+			csd.Config = newConfig
+			csd.consulClient = client
+			csd.clientMu.Unlock()
+
+			csd.tokenMu.Lock()
+			if !csd.registerTokenOverridden {
+				csd.registerToken = token
+			}
+			if !csd.queryTokenOverridden {
+				csd.queryToken = token
+			}
+			if !csd.watchTokenOverridden {
+				csd.watchToken = token
+			}
+			csd.tokenMu.Unlock()
+
+			logger.Info("consul acl token rotated")
+		}
+	}
+}
+
+// bootstrapACLCheck fails fast if the configured token cannot register services under prefix,
+// catching a misconfigured ACL policy at startup instead of at the first real Register call. It
+// does so by actually exercising the permission: registering and immediately deregistering a
+// throwaway probe service, since Consul does not expose a direct "can I do X" query.
+func (csd *consulServiceDiscovery) bootstrapACLCheck(prefix string) error {
+	probeID := prefix + "-dubbo-acl-bootstrap-probe"
+
+	err := csd.client().Agent().ServiceRegister(&consul.AgentServiceRegistration{
+		ID:        probeID,
+		Name:      prefix,
+		Tags:      []string{"dubbo-acl-bootstrap-probe"},
+		Token:     csd.getRegisterToken(),
+		Namespace: csd.namespace,
+		Partition: csd.partition,
+	})
+	if err != nil {
+		return perrors.WithMessage(err, "acl token lacks service:write for prefix "+prefix)
+	}
+
+	if err := csd.client().Agent().ServiceDeregister(probeID); err != nil {
+		logger.Warnf("acl bootstrap probe %s registered but could not be cleaned up: %v", probeID, err)
+	}
+	return nil
+}
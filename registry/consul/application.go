@@ -0,0 +1,291 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+import (
+	consul "github.com/hashicorp/consul/api"
+	perrors "github.com/pkg/errors"
+)
+
+import (
+	"github.com/apache/dubbo-go/common/logger"
+	"github.com/apache/dubbo-go/registry"
+)
+
+const (
+	// applicationModeParam switches Register/GetInstances to the application-level discovery model,
+	// where one Consul service represents an application rather than one Consul service per interface.
+	applicationModeParam = "application-mode"
+
+	// metaRevisionKey is the Meta key an application instance carries its metadata revision hash under.
+	metaRevisionKey = "dubbo.metadata.revision"
+
+	metadataKVPrefix = "dubbo/metadata"
+)
+
+// ServiceInfo is the subset of an exported interface's metadata an application instance advertises.
+type ServiceInfo struct {
+	Name    string `json:"name"`
+	Group   string `json:"group,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// MetadataInfo is the revision-tagged blob describing every interface an application instance
+// exports. It is read from the in-process revision cache or from the Consul KV entry this discovery
+// publishes at registration time; it is never fetched from the instance's MetadataService over RPC.
+type MetadataInfo struct {
+	Revision string                 `json:"revision"`
+	App      string                 `json:"app"`
+	Services map[string]ServiceInfo `json:"services"`
+}
+
+// registerApplicationInstance implements application-level Register: instance is treated as one of
+// possibly many interfaces exported by the same physical instance (identified by host:port). Every
+// call folds instance into that instance's running interface set, recomputes its revision, and
+// (re)registers a single Consul service named after the application rather than the interface.
+func (csd *consulServiceDiscovery) registerApplicationInstance(instance registry.ServiceInstance) error {
+	key := instanceKey(instance)
+	interfaceName := instance.GetServiceName()
+
+	csd.appMu.Lock()
+	interfaces, ok := csd.exportedInterfaces[key]
+	if !ok {
+		interfaces = make(map[string]registry.ServiceInstance)
+		csd.exportedInterfaces[key] = interfaces
+	}
+	interfaces[interfaceName] = instance
+	revision := buildRevision(csd.applicationName, interfaces)
+	info := buildMetadataInfo(csd.applicationName, revision, interfaces)
+	csd.revisionCache[revision] = info
+	csd.appMu.Unlock()
+
+	return csd.reconcileApplicationInstance(instance, revision, info)
+}
+
+// reconcileApplicationInstance (re)registers the Consul-facing side of the application instance
+// identified by representative's host:port so that it advertises revision/info: the Consul service
+// registration, the KV metadata fallback, and, if the check strategy needs one, the TTL heartbeat.
+// registerApplicationInstance and unregisterApplicationInstance both call this once they've already
+// settled on the exported interface set under appMu, so this never touches exportedInterfaces itself
+// and never re-adds an interface a caller just removed.
+func (csd *consulServiceDiscovery) reconcileApplicationInstance(representative registry.ServiceInstance, revision string, info *MetadataInfo) error {
+	appInstance := &registry.DefaultServiceInstance{
+		Id:          instanceKey(representative),
+		ServiceName: csd.applicationName,
+		Host:        representative.GetHost(),
+		Port:        representative.GetPort(),
+		Enable:      representative.IsEnable(),
+		Healthy:     representative.IsHealthy(),
+		Metadata:    map[string]string{metaRevisionKey: revision},
+	}
+
+	ins, _ := csd.buildRegisterInstance(appInstance)
+	if err := csd.client().Agent().ServiceRegister(ins); err != nil {
+		return perrors.WithMessage(err, "consul could not register the application instance. "+csd.applicationName)
+	}
+
+	if err := csd.publishMetadataInfo(info); err != nil {
+		logger.Warnf("publish metadata info for revision %s failed, GetInstances without this revision cached cannot resolve it until the instance is registered again: %v", revision, err)
+	}
+
+	if !csd.checkStrategy.RequiresHeartbeat() {
+		return nil
+	}
+	return csd.registerTtl(appInstance)
+}
+
+// updateApplicationInstance implements application-level Update by simply re-running
+// registerApplicationInstance: it recomputes the revision from the (possibly changed) instance and
+// re-registers the application instance, exactly as a fresh Register would.
+func (csd *consulServiceDiscovery) updateApplicationInstance(instance registry.ServiceInstance) error {
+	return csd.registerApplicationInstance(instance)
+}
+
+// unregisterApplicationInstance implements application-level Unregister: it drops interfaceName from
+// the application instance's exported interface set. If other interfaces are still exported by the
+// same application instance (identified by host:port), the application instance is re-registered
+// with the shrunk interface set and recomputed revision; otherwise the application instance itself is
+// deregistered from Consul and its TTL heartbeat, if any, is stopped.
+func (csd *consulServiceDiscovery) unregisterApplicationInstance(instance registry.ServiceInstance) error {
+	key := instanceKey(instance)
+	interfaceName := instance.GetServiceName()
+
+	csd.appMu.Lock()
+	interfaces, ok := csd.exportedInterfaces[key]
+	if !ok {
+		csd.appMu.Unlock()
+		return nil
+	}
+	delete(interfaces, interfaceName)
+	remaining := len(interfaces)
+	var revision string
+	var info *MetadataInfo
+	if remaining == 0 {
+		delete(csd.exportedInterfaces, key)
+	} else {
+		revision = buildRevision(csd.applicationName, interfaces)
+		info = buildMetadataInfo(csd.applicationName, revision, interfaces)
+		csd.revisionCache[revision] = info
+	}
+	csd.appMu.Unlock()
+
+	if remaining > 0 {
+		return csd.reconcileApplicationInstance(instance, revision, info)
+	}
+
+	appInstance := &registry.DefaultServiceInstance{
+		Id:          key,
+		ServiceName: csd.applicationName,
+		Host:        instance.GetHost(),
+		Port:        instance.GetPort(),
+	}
+	return csd.deregisterConsulInstance(buildID(appInstance))
+}
+
+// getApplicationInstances implements application-level GetInstances: it resolves the application's
+// Consul instances, fetches (or reuses from cache) each one's metadata blob, and keeps only those
+// that actually export interfaceName.
+func (csd *consulServiceDiscovery) getApplicationInstances(interfaceName string) []registry.ServiceInstance {
+	appInstances := csd.getRawInstances(csd.applicationName)
+
+	res := make([]registry.ServiceInstance, 0, len(appInstances))
+	for _, ins := range appInstances {
+		revision := ins.GetMetadata()[metaRevisionKey]
+		info, err := csd.getMetadataInfo(ins, revision)
+		if err != nil {
+			logger.Warnf("get metadata info for application instance %s (revision %s) failed, skipping it: %v", ins.GetId(), revision, err)
+			continue
+		}
+		if _, exported := info.Services[interfaceName]; !exported {
+			continue
+		}
+		res = append(res, ins)
+	}
+	return res
+}
+
+// getMetadataInfo returns the MetadataInfo for revision, preferring the shared in-process cache so
+// that every instance sharing a revision only fetches it once. On a cache miss it falls back to the
+// Consul KV entry published by registerApplicationInstance, since a live MetadataService RPC client
+// is wired up by the upper metadata module rather than this registry implementation.
+func (csd *consulServiceDiscovery) getMetadataInfo(instance registry.ServiceInstance, revision string) (*MetadataInfo, error) {
+	if revision == "" {
+		return nil, perrors.New("instance " + instance.GetId() + " carries no " + metaRevisionKey)
+	}
+
+	csd.appMu.Lock()
+	info, ok := csd.revisionCache[revision]
+	csd.appMu.Unlock()
+	if ok {
+		return info, nil
+	}
+
+	info, err := csd.fetchMetadataInfoFromKV(revision)
+	if err != nil {
+		return nil, err
+	}
+
+	csd.appMu.Lock()
+	csd.revisionCache[revision] = info
+	csd.appMu.Unlock()
+	return info, nil
+}
+
+// publishMetadataInfo writes info to the dubbo/metadata/<app>/<revision> KV entry so that any
+// instance (including ones in other processes) can resolve the revision without an RPC round trip.
+func (csd *consulServiceDiscovery) publishMetadataInfo(info *MetadataInfo) error {
+	raw, err := json.Marshal(info)
+	if err != nil {
+		return perrors.WithMessage(err, "marshal metadata info failed")
+	}
+	_, err = csd.client().KV().Put(&consul.KVPair{
+		Key:       metadataKVKey(csd.applicationName, info.Revision),
+		Value:     raw,
+		Namespace: csd.namespace,
+		Partition: csd.partition,
+	}, &consul.WriteOptions{Token: csd.getRegisterToken(), Namespace: csd.namespace, Partition: csd.partition})
+	return err
+}
+
+func (csd *consulServiceDiscovery) fetchMetadataInfoFromKV(revision string) (*MetadataInfo, error) {
+	pair, _, err := csd.client().KV().Get(metadataKVKey(csd.applicationName, revision), &consul.QueryOptions{
+		Token:     csd.getQueryToken(),
+		Namespace: csd.namespace,
+		Partition: csd.partition,
+	})
+	if err != nil {
+		return nil, perrors.WithMessage(err, "get metadata info from consul kv failed")
+	}
+	if pair == nil {
+		return nil, perrors.New("no metadata info found in consul kv for revision " + revision)
+	}
+
+	info := &MetadataInfo{}
+	if err := json.Unmarshal(pair.Value, info); err != nil {
+		return nil, perrors.WithMessage(err, "unmarshal metadata info failed")
+	}
+	return info, nil
+}
+
+func metadataKVKey(app, revision string) string {
+	return fmt.Sprintf("%s/%s/%s", metadataKVPrefix, app, revision)
+}
+
+func instanceKey(instance registry.ServiceInstance) string {
+	return instance.GetHost() + ":" + strconv.Itoa(instance.GetPort())
+}
+
+func buildMetadataInfo(app, revision string, interfaces map[string]registry.ServiceInstance) *MetadataInfo {
+	services := make(map[string]ServiceInfo, len(interfaces))
+	for name, instance := range interfaces {
+		services[name] = ServiceInfo{
+			Name:    name,
+			Group:   instance.GetMetadata()["group"],
+			Version: instance.GetMetadata()["version"],
+		}
+	}
+	return &MetadataInfo{Revision: revision, App: app, Services: services}
+}
+
+// buildRevision hashes the exported interface set into a short, stable identifier, so that two
+// instances exporting the same interfaces converge on the same revision and therefore the same
+// cached metadata fetch.
+func buildRevision(app string, interfaces map[string]registry.ServiceInstance) string {
+	names := make([]string, 0, len(interfaces))
+	for name := range interfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	h.Write([]byte(app))
+	for _, name := range names {
+		h.Write([]byte{0})
+		h.Write([]byte(name))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
@@ -0,0 +1,296 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"strconv"
+	"strings"
+)
+
+import (
+	consul "github.com/hashicorp/consul/api"
+)
+
+import (
+	"github.com/apache/dubbo-go/common"
+	"github.com/apache/dubbo-go/registry"
+)
+
+const (
+	checkTypeParam     = "check.type"
+	checkIntervalParam = "check.interval"
+	checkTimeoutParam  = "check.timeout"
+	checkTLSSkipVerify = "check.tls-skip-verify"
+
+	checkHTTPParam       = "check.http"
+	checkHTTPMethodParam = "check.http-method"
+	checkHTTPHeaderParam = "check.http-header"
+
+	checkGRPCParam       = "check.grpc"
+	checkGRPCUseTLSParam = "check.grpc-use-tls"
+
+	checkTCPParam = "check.tcp"
+
+	checkScriptParam = "check.script"
+
+	defaultCheckInterval = "10s"
+
+	checkTypeTTL    = "ttl"
+	checkTypeHTTP   = "http"
+	checkTypeGRPC   = "grpc"
+	checkTypeTCP    = "tcp"
+	checkTypeScript = "script"
+)
+
+// CheckStrategy builds the consul.AgentServiceCheck(s) registered alongside a service instance.
+// Only the ttl strategy requires dubbo-go to actively heartbeat the instance; every other strategy
+// has Consul itself poll/exec the check, which is reflected in RequiresHeartbeat.
+type CheckStrategy interface {
+	// Name identifies the strategy, matching the check.type URL param that selects it.
+	Name() string
+	// BuildChecks returns the checks to register for instance. Most strategies return exactly one,
+	// but the interface returns a slice so a caller can opt into registering several (e.g. TTL plus
+	// an HTTP check) by composing strategies ahead of time.
+	BuildChecks(csd *consulServiceDiscovery, instance registry.ServiceInstance) consul.AgentServiceChecks
+	// RequiresHeartbeat reports whether registerTtl's background PassTTL goroutine must run.
+	RequiresHeartbeat() bool
+}
+
+// newCheckStrategy selects a CheckStrategy from the check.type URL param, defaulting to ttl so
+// existing configurations keep behaving exactly as before. check.type accepts a comma-separated list
+// (e.g. "ttl,http") to register several checks for the same instance, in which case the individual
+// strategies are composed via compositeCheckStrategy.
+func newCheckStrategy(registryURL common.URL) CheckStrategy {
+	types := strings.Split(registryURL.GetParam(checkTypeParam, checkTypeTTL), ",")
+	if len(types) == 1 {
+		return singleCheckStrategy(strings.TrimSpace(types[0]))
+	}
+
+	strategies := make([]CheckStrategy, 0, len(types))
+	for _, t := range types {
+		strategies = append(strategies, singleCheckStrategy(strings.TrimSpace(t)))
+	}
+	return &compositeCheckStrategy{strategies: strategies}
+}
+
+func singleCheckStrategy(checkType string) CheckStrategy {
+	switch checkType {
+	case checkTypeHTTP:
+		return &httpCheckStrategy{}
+	case checkTypeGRPC:
+		return &grpcCheckStrategy{}
+	case checkTypeTCP:
+		return &tcpCheckStrategy{}
+	case checkTypeScript:
+		return &scriptCheckStrategy{}
+	default:
+		return &ttlCheckStrategy{}
+	}
+}
+
+// compositeCheckStrategy registers the checks of several strategies against the same instance, e.g.
+// a TTL self-heartbeat alongside an HTTP check Consul polls independently. RequiresHeartbeat reports
+// true if any composed strategy needs the PassTTL goroutine.
+type compositeCheckStrategy struct {
+	strategies []CheckStrategy
+}
+
+func (s *compositeCheckStrategy) Name() string {
+	names := make([]string, len(s.strategies))
+	for i, strategy := range s.strategies {
+		names[i] = strategy.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (s *compositeCheckStrategy) RequiresHeartbeat() bool {
+	for _, strategy := range s.strategies {
+		if strategy.RequiresHeartbeat() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *compositeCheckStrategy) BuildChecks(csd *consulServiceDiscovery, instance registry.ServiceInstance) consul.AgentServiceChecks {
+	checks := make(consul.AgentServiceChecks, 0, len(s.strategies))
+	for _, strategy := range s.strategies {
+		checks = append(checks, strategy.BuildChecks(csd, instance)...)
+	}
+	return checks
+}
+
+func checkInterval(instance registry.ServiceInstance) string {
+	if v := instance.GetMetadata()[checkIntervalParam]; v != "" {
+		return v
+	}
+	return defaultCheckInterval
+}
+
+// ttlCheckStrategy is the original behaviour: dubbo-go self-heartbeats via Agent().PassTTL.
+type ttlCheckStrategy struct{}
+
+func (s *ttlCheckStrategy) Name() string { return checkTypeTTL }
+
+func (s *ttlCheckStrategy) RequiresHeartbeat() bool { return true }
+
+func (s *ttlCheckStrategy) BuildChecks(csd *consulServiceDiscovery, instance registry.ServiceInstance) consul.AgentServiceChecks {
+	return consul.AgentServiceChecks{{
+		CheckID:                        buildID(instance),
+		TTL:                            strconv.FormatInt(csd.checkPassInterval/1000, 10) + "s",
+		DeregisterCriticalServiceAfter: buildDeregisterAfter(instance),
+	}}
+}
+
+// httpCheckStrategy lets Consul poll an HTTP(S) endpoint on the instance itself.
+type httpCheckStrategy struct{}
+
+func (s *httpCheckStrategy) Name() string { return checkTypeHTTP }
+
+func (s *httpCheckStrategy) RequiresHeartbeat() bool { return false }
+
+func (s *httpCheckStrategy) BuildChecks(csd *consulServiceDiscovery, instance registry.ServiceInstance) consul.AgentServiceChecks {
+	meta := instance.GetMetadata()
+	path := meta[checkHTTPParam]
+	if path == "" {
+		path = "/health"
+	}
+
+	return consul.AgentServiceChecks{{
+		CheckID:                        buildCheckID(instance, checkTypeHTTP),
+		HTTP:                           buildCheckURL(instance, path),
+		Method:                         firstNonEmpty(meta[checkHTTPMethodParam], "GET"),
+		Header:                         parseCheckHeaders(meta[checkHTTPHeaderParam]),
+		Interval:                       checkInterval(instance),
+		Timeout:                        meta[checkTimeoutParam],
+		TLSSkipVerify:                  meta[checkTLSSkipVerify] == "true",
+		DeregisterCriticalServiceAfter: buildDeregisterAfter(instance),
+	}}
+}
+
+// grpcCheckStrategy lets Consul poll the instance's grpc.health.v1 Health service.
+type grpcCheckStrategy struct{}
+
+func (s *grpcCheckStrategy) Name() string { return checkTypeGRPC }
+
+func (s *grpcCheckStrategy) RequiresHeartbeat() bool { return false }
+
+func (s *grpcCheckStrategy) BuildChecks(csd *consulServiceDiscovery, instance registry.ServiceInstance) consul.AgentServiceChecks {
+	meta := instance.GetMetadata()
+	target := meta[checkGRPCParam]
+	if target == "" {
+		target = instance.GetHost() + ":" + strconv.Itoa(instance.GetPort())
+	}
+
+	return consul.AgentServiceChecks{{
+		CheckID:                        buildCheckID(instance, checkTypeGRPC),
+		GRPC:                           target,
+		GRPCUseTLS:                     meta[checkGRPCUseTLSParam] == "true",
+		Interval:                       checkInterval(instance),
+		TLSSkipVerify:                  meta[checkTLSSkipVerify] == "true",
+		DeregisterCriticalServiceAfter: buildDeregisterAfter(instance),
+	}}
+}
+
+// tcpCheckStrategy lets Consul probe a TCP address for liveness.
+type tcpCheckStrategy struct{}
+
+func (s *tcpCheckStrategy) Name() string { return checkTypeTCP }
+
+func (s *tcpCheckStrategy) RequiresHeartbeat() bool { return false }
+
+func (s *tcpCheckStrategy) BuildChecks(csd *consulServiceDiscovery, instance registry.ServiceInstance) consul.AgentServiceChecks {
+	meta := instance.GetMetadata()
+	addr := meta[checkTCPParam]
+	if addr == "" {
+		addr = instance.GetHost() + ":" + strconv.Itoa(instance.GetPort())
+	}
+
+	return consul.AgentServiceChecks{{
+		CheckID:                        buildCheckID(instance, checkTypeTCP),
+		TCP:                            addr,
+		Interval:                       checkInterval(instance),
+		DeregisterCriticalServiceAfter: buildDeregisterAfter(instance),
+	}}
+}
+
+// scriptCheckStrategy lets the local Consul agent exec a script/docker check on its own schedule.
+type scriptCheckStrategy struct{}
+
+func (s *scriptCheckStrategy) Name() string { return checkTypeScript }
+
+func (s *scriptCheckStrategy) RequiresHeartbeat() bool { return false }
+
+func (s *scriptCheckStrategy) BuildChecks(csd *consulServiceDiscovery, instance registry.ServiceInstance) consul.AgentServiceChecks {
+	meta := instance.GetMetadata()
+
+	return consul.AgentServiceChecks{{
+		CheckID:                        buildCheckID(instance, checkTypeScript),
+		Args:                           strings.Fields(meta[checkScriptParam]),
+		DockerContainerID:              meta["check.docker-container-id"],
+		Shell:                          meta["check.shell"],
+		Interval:                       checkInterval(instance),
+		DeregisterCriticalServiceAfter: buildDeregisterAfter(instance),
+	}}
+}
+
+// buildCheckID scopes a check's CheckID to checkType, so composing several strategies for the same
+// instance (e.g. "check.type=ttl,http") registers distinct checks instead of each one overwriting the
+// last. The ttl strategy deliberately does not use this: its CheckID must stay buildID(instance)
+// exactly, since registerTtl/runTtlHeartbeat key PassTTL calls off that same value.
+func buildCheckID(instance registry.ServiceInstance, checkType string) string {
+	return buildID(instance) + ":" + checkType
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// buildCheckURL turns a bare path (e.g. "/health") into a full URL against the instance's own
+// address, leaving an already-absolute URL (http://... or https://...) untouched.
+func buildCheckURL(instance registry.ServiceInstance, path string) string {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return "http://" + instance.GetHost() + ":" + strconv.Itoa(instance.GetPort()) + path
+}
+
+// parseCheckHeaders turns a "Key1:Value1,Key2:Value2" metadata value into the map[string][]string
+// shape consul.AgentServiceCheck.Header expects.
+func parseCheckHeaders(raw string) map[string][]string {
+	if raw == "" {
+		return nil
+	}
+	header := make(map[string][]string)
+	for _, pair := range strings.Split(raw, ",") {
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		header[kv[0]] = append(header[kv[0]], kv[1])
+	}
+	return header
+}
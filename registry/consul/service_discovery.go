@@ -18,6 +18,7 @@
 package consul
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
@@ -29,7 +30,6 @@ import (
 	"github.com/dubbogo/gost/container/set"
 	"github.com/dubbogo/gost/page"
 	consul "github.com/hashicorp/consul/api"
-	"github.com/hashicorp/consul/api/watch"
 	perrors "github.com/pkg/errors"
 )
 
@@ -44,6 +44,20 @@ import (
 
 const (
 	enable = "enable"
+
+	// connectEnabledParam turns on Consul Connect-aware registration for the service, see Init.
+	connectEnabledParam = "connect"
+	// connectNativeParam registers the service as Connect-native instead of behind a sidecar proxy.
+	connectNativeParam = "connect.native"
+	// connectUpstreamsParam is a comma separated "serviceName:localPort" list describing the upstreams
+	// the generated sidecar proxy should expose, e.g. "user-service:9001,order-service:9002".
+	connectUpstreamsParam = "connect.upstreams"
+	// connectSidecarPortParam is the port the sidecar proxy listens on, defaulting to instance port + 1.
+	connectSidecarPortParam = "connect.sidecar-port"
+
+	// metadata keys used to surface Connect/mTLS material to upper layers.
+	metaConnectNative  = "dubbo.connect.native"
+	metaConnectCARoots = "dubbo.connect.ca-roots"
 )
 
 var (
@@ -87,9 +101,12 @@ func newConsulServiceDiscovery(name string) (registry.ServiceDiscovery, error) {
 	descriptor := fmt.Sprintf("consul-service-discovery[%s]", remoteConfig.Address)
 
 	return &consulServiceDiscovery{
-		address:    remoteConfig.Address,
-		descriptor: descriptor,
-		ttl:        make(map[string]chan struct{}),
+		address:            remoteConfig.Address,
+		descriptor:         descriptor,
+		ttl:                make(map[string]context.CancelFunc),
+		watchers:           make(map[string]*serviceWatcher),
+		exportedInterfaces: make(map[string]map[string]registry.ServiceInstance),
+		revisionCache:      make(map[string]*MetadataInfo),
 	}, nil
 }
 
@@ -100,14 +117,60 @@ type consulServiceDiscovery struct {
 	group string
 	// descriptor is a short string about the basic information of this instance
 	descriptor string
-	// Consul client.
+	// Consul client. clientMu guards it so a token rotation can swap it out without racing readers.
+	clientMu          sync.RWMutex
 	consulClient      *consul.Client
 	serviceUrl        common.URL
 	checkPassInterval int64
 	tag               string
 	tags              []string
 	address           string
-	ttl               map[string]chan struct{}
+	// ttlMu guards ttl.
+	ttlMu sync.RWMutex
+	// ttl holds the cancel func of each instance's running TTL heartbeat goroutine, keyed by checkID.
+	ttl map[string]context.CancelFunc
+	// connectEnabled registers services as Consul Connect-aware, either natively or via a sidecar proxy.
+	connectEnabled bool
+	// connectNative marks the service itself as able to speak Connect's mTLS, skipping the sidecar.
+	connectNative bool
+	// rootCtx is canceled by Destroy and is the parent of every watcher/heartbeat goroutine context.
+	rootCtx    context.Context
+	rootCancel context.CancelFunc
+	// watchersMu guards watchers.
+	watchersMu sync.Mutex
+	// watchers holds the one shared long-poll goroutine per subscribed service, keyed by service name.
+	watchers map[string]*serviceWatcher
+	// checkStrategy builds the AgentServiceCheck(s) registered alongside each instance; defaults to TTL.
+	checkStrategy CheckStrategy
+	// applicationModeEnabled switches Register/GetInstances to the application-level model, where one
+	// Consul service represents the whole application instead of one Consul service per interface.
+	applicationModeEnabled bool
+	applicationName        string
+	// appMu guards exportedInterfaces and revisionCache.
+	appMu sync.Mutex
+	// exportedInterfaces tracks, per application instance (keyed by host:port), every interface that
+	// instance has exported so far, so Register can recompute the instance's revision on each call.
+	exportedInterfaces map[string]map[string]registry.ServiceInstance
+	// revisionCache lets every application instance sharing a revision fetch its metadata blob once.
+	revisionCache map[string]*MetadataInfo
+	// namespace/partition are threaded through every write/query as Consul Enterprise scoping.
+	namespace string
+	partition string
+	// tokenMu guards registerToken/queryToken/watchToken, which watchTokenRotation mutates in place
+	// whenever they were defaulted from the main token (see the *Overridden flags).
+	tokenMu       sync.RWMutex
+	registerToken string
+	queryToken    string
+	watchToken    string
+	// registerTokenOverridden/queryTokenOverridden/watchTokenOverridden record whether each token was
+	// set explicitly via its own URL param, so watchTokenRotation knows not to clobber it with the
+	// rotated main token.
+	registerTokenOverridden bool
+	queryTokenOverridden    bool
+	watchTokenOverridden    bool
+	// tokenProvider supplies the main ACL token and, for rotating providers, is polled by
+	// watchTokenRotation so a changed token rebuilds consulClient without restarting the discovery.
+	tokenProvider TokenProvider
 	*consul.Config
 }
 
@@ -116,13 +179,49 @@ func (csd *consulServiceDiscovery) Init(registryURL common.URL) error {
 	csd.checkPassInterval = registryURL.GetParamInt(constant.CHECK_PASS_INTERVAL, constant.DEFAULT_CHECK_PASS_INTERVAL)
 	csd.tag = registryURL.GetParam(constant.QUERY_TAG, "")
 	csd.tags = strings.Split(registryURL.GetParam("tags", ""), ",")
+	csd.connectEnabled = registryURL.GetParamBool(connectEnabledParam, false)
+	csd.connectNative = registryURL.GetParamBool(connectNativeParam, false)
+	csd.checkStrategy = newCheckStrategy(registryURL)
+	csd.applicationModeEnabled = registryURL.GetParamBool(applicationModeParam, false)
+	csd.applicationName = registryURL.GetParam(constant.APPLICATION_KEY, "")
+
+	csd.namespace = registryURL.GetParam(aclNamespaceParam, "")
+	csd.partition = registryURL.GetParam(aclPartitionParam, "")
+
 	aclToken := registryURL.GetParam(constant.ACL_TOKEN, "")
-	csd.Config = &consul.Config{Address: csd.address, Token: aclToken}
+	csd.tokenProvider = newTokenProvider(registryURL, aclToken)
+	token, err := csd.tokenProvider.Token()
+	if err != nil {
+		return perrors.WithMessage(err, "resolve initial acl token failed")
+	}
+	explicitRegisterToken := registryURL.GetParam(aclTokenRegisterParam, "")
+	explicitQueryToken := registryURL.GetParam(aclTokenQueryParam, "")
+	explicitWatchToken := registryURL.GetParam(aclTokenWatchParam, "")
+	csd.registerTokenOverridden = explicitRegisterToken != ""
+	csd.queryTokenOverridden = explicitQueryToken != ""
+	csd.watchTokenOverridden = explicitWatchToken != ""
+	csd.registerToken = firstNonEmpty(explicitRegisterToken, token)
+	csd.queryToken = firstNonEmpty(explicitQueryToken, token)
+	csd.watchToken = firstNonEmpty(explicitWatchToken, token)
+
+	csd.Config = &consul.Config{Address: csd.address, Token: token, Namespace: csd.namespace, Partition: csd.partition}
 	client, err := consul.NewClient(csd.Config)
 	if err != nil {
 		return perrors.WithMessage(err, "create consul client failed.")
 	}
-	csd.consulClient = client
+	csd.setClient(client)
+	csd.rootCtx, csd.rootCancel = context.WithCancel(context.Background())
+
+	if prefix := registryURL.GetParam(aclBootstrapPrefixParam, ""); prefix != "" {
+		if err := csd.bootstrapACLCheck(prefix); err != nil {
+			return err
+		}
+	}
+
+	if rotateInterval := registryURL.GetParamInt(aclTokenRotateIntervalParam, 0); rotateInterval > 0 {
+		go csd.watchTokenRotation(time.Duration(rotateInterval) * time.Millisecond)
+	}
+
 	return nil
 }
 
@@ -130,75 +229,191 @@ func (csd *consulServiceDiscovery) String() string {
 	return csd.descriptor
 }
 
+// client returns the current Consul client. It is a method, not a plain field read, so that token
+// rotation can swap the client under csd.clientMu without requiring every caller to hold a lock.
+func (csd *consulServiceDiscovery) client() *consul.Client {
+	csd.clientMu.RLock()
+	defer csd.clientMu.RUnlock()
+	return csd.consulClient
+}
+
+func (csd *consulServiceDiscovery) setClient(client *consul.Client) {
+	csd.clientMu.Lock()
+	csd.consulClient = client
+	csd.clientMu.Unlock()
+}
+
+// getRegisterToken/getQueryToken/getWatchToken return the token currently in effect for each
+// operation kind. They're read through a lock because watchTokenRotation may update them
+// concurrently with a Register/GetInstances/AddListener call in flight.
+func (csd *consulServiceDiscovery) getRegisterToken() string {
+	csd.tokenMu.RLock()
+	defer csd.tokenMu.RUnlock()
+	return csd.registerToken
+}
+
+func (csd *consulServiceDiscovery) getQueryToken() string {
+	csd.tokenMu.RLock()
+	defer csd.tokenMu.RUnlock()
+	return csd.queryToken
+}
+
+func (csd *consulServiceDiscovery) getWatchToken() string {
+	csd.tokenMu.RLock()
+	defer csd.tokenMu.RUnlock()
+	return csd.watchToken
+}
+
 func (csd *consulServiceDiscovery) Destroy() error {
-	csd.consulClient = nil
-	for _, t := range csd.ttl {
-		close(t)
+	if csd.rootCancel != nil {
+		csd.rootCancel()
 	}
-	csd.ttl = nil
+	csd.watchersMu.Lock()
+	csd.watchers = make(map[string]*serviceWatcher)
+	csd.watchersMu.Unlock()
+
+	// Every heartbeat context is derived from rootCtx, so canceling it above tells them all to stop; a
+	// heartbeat that ticks after the client is dropped below sees a nil client and returns. This just
+	// drops the now-stale cancel funcs instead of leaving them in the map.
+	csd.ttlMu.Lock()
+	csd.ttl = make(map[string]context.CancelFunc)
+	csd.ttlMu.Unlock()
+
+	csd.setClient(nil)
 	return nil
 }
 
 func (csd *consulServiceDiscovery) Register(instance registry.ServiceInstance) error {
+	if csd.applicationModeEnabled {
+		return csd.registerApplicationInstance(instance)
+	}
+
 	ins, _ := csd.buildRegisterInstance(instance)
-	err := csd.consulClient.Agent().ServiceRegister(ins)
+	err := csd.client().Agent().ServiceRegister(ins)
 	if err != nil {
 		return perrors.WithMessage(err, "consul could not register the instance. "+instance.GetServiceName())
 	}
 
+	if !csd.checkStrategy.RequiresHeartbeat() {
+		return nil
+	}
 	return csd.registerTtl(instance)
 }
 
+// ttlReregisterThreshold is how many consecutive PassTTL failures are tolerated before the
+// heartbeat goroutine assumes Consul GC'd the check (via DeregisterCriticalServiceAfter) and
+// attempts to re-register the instance rather than spinning forever against a dead check.
+const ttlReregisterThreshold = 3
+
 func (csd *consulServiceDiscovery) registerTtl(instance registry.ServiceInstance) error {
 	checkID := buildID(instance)
+	ctx, cancel := context.WithCancel(csd.rootCtx)
 
-	stopChan := make(chan struct{})
-	csd.ttl[buildID(instance)] = stopChan
+	csd.ttlMu.Lock()
+	if oldCancel, ok := csd.ttl[checkID]; ok {
+		oldCancel()
+	}
+	csd.ttl[checkID] = cancel
+	csd.ttlMu.Unlock()
 
 	period := time.Duration(csd.checkPassInterval/8) * time.Millisecond
-	timer := time.NewTimer(period)
-	go func() {
-		for {
-			select {
-			case <-timer.C:
-				timer.Reset(period)
-				err := csd.consulClient.Agent().PassTTL(checkID, "")
-				if err != nil {
-					logger.Warnf("pass ttl heartbeat fail:%v", err)
-					break
-				}
-				logger.Debugf("passed ttl heartbeat for %s", checkID)
-				break
-			case <-stopChan:
-				logger.Info("ttl %s for service %s is stopped", checkID, instance.GetServiceName())
+	go csd.runTtlHeartbeat(ctx, instance, checkID, period)
+	return nil
+}
+
+// runTtlHeartbeat periodically calls PassTTL for checkID until ctx is canceled (by Unregister or
+// Destroy). After ttlReregisterThreshold consecutive failures it attempts to re-register the
+// instance, since Consul may have already deregistered the check via
+// DeregisterCriticalServiceAfter, which PassTTL alone can never recover from.
+func (csd *consulServiceDiscovery) runTtlHeartbeat(ctx context.Context, instance registry.ServiceInstance, checkID string, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Infof("ttl %s for service %s is stopped", checkID, instance.GetServiceName())
+			return
+		case <-ticker.C:
+			client := csd.client()
+			if client == nil {
+				// Destroy already tore the client down; its rootCtx cancel stops this goroutine too.
 				return
 			}
+			if err := client.Agent().PassTTL(checkID, ""); err != nil {
+				failures++
+				logger.Warnf("pass ttl heartbeat fail (%d consecutive):%v", failures, err)
+				if failures < ttlReregisterThreshold {
+					continue
+				}
+				ins, _ := csd.buildRegisterInstance(instance)
+				if rerr := client.Agent().ServiceRegister(ins); rerr != nil {
+					logger.Errorf("re-register instance %s after repeated ttl failures failed: %v", instance.GetId(), rerr)
+					continue
+				}
+				logger.Warnf("re-registered instance %s after %d consecutive ttl failures", instance.GetId(), failures)
+				failures = 0
+				continue
+			}
+			failures = 0
+			logger.Debugf("passed ttl heartbeat for %s", checkID)
 		}
-	}()
-	return nil
+	}
 }
 
 func (csd *consulServiceDiscovery) Update(instance registry.ServiceInstance) error {
+	if csd.applicationModeEnabled {
+		return csd.updateApplicationInstance(instance)
+	}
+
 	ins, _ := csd.buildRegisterInstance(instance)
-	err := csd.consulClient.Agent().ServiceDeregister(buildID(instance))
+	err := csd.client().Agent().ServiceDeregister(buildID(instance))
 	if err != nil {
 		logger.Warnf("unregister instance %s fail:%v", instance.GetServiceName(), err)
 	}
-	return csd.consulClient.Agent().ServiceRegister(ins)
+	if err := csd.client().Agent().ServiceRegister(ins); err != nil {
+		return err
+	}
+
+	if !csd.checkStrategy.RequiresHeartbeat() {
+		return nil
+	}
+	return csd.registerTtl(instance)
 }
 
+// Unregister is idempotent: calling it more than once for the same instance (or concurrently with
+// Destroy) is safe and only the first caller actually stops anything.
 func (csd *consulServiceDiscovery) Unregister(instance registry.ServiceInstance) error {
-	err := csd.consulClient.Agent().ServiceDeregister(buildID(instance))
-	if err != nil {
-		logger.Errorf("unregister service instance %s,error: %v", instance.GetId(), err)
-		return err
+	if csd.applicationModeEnabled {
+		return csd.unregisterApplicationInstance(instance)
 	}
-	stopChanel, ok := csd.ttl[buildID(instance)]
-	if !ok {
-		logger.Warnf("ttl for service instance %s didn't exist", instance.GetId())
-	} else {
-		close(stopChanel)
-		delete(csd.ttl, buildID(instance))
+	return csd.deregisterConsulInstance(buildID(instance))
+}
+
+// deregisterConsulInstance stops checkID's TTL heartbeat, if any, and deregisters it from Consul. It
+// is idempotent: calling it more than once for the same checkID (or concurrently with Destroy) is
+// safe and only the first caller actually stops anything.
+func (csd *consulServiceDiscovery) deregisterConsulInstance(checkID string) error {
+	csd.ttlMu.Lock()
+	cancel, ok := csd.ttl[checkID]
+	if ok {
+		delete(csd.ttl, checkID)
+	}
+	csd.ttlMu.Unlock()
+	if ok {
+		cancel()
+	}
+
+	client := csd.client()
+	if client == nil {
+		// Destroy already tore the client down; there is nothing left to deregister.
+		return nil
+	}
+
+	if err := client.Agent().ServiceDeregister(checkID); err != nil {
+		logger.Errorf("unregister service instance %s,error: %v", checkID, err)
+		return err
 	}
 	return nil
 }
@@ -210,7 +425,7 @@ func (csd *consulServiceDiscovery) GetDefaultPageSize() int {
 func (csd *consulServiceDiscovery) GetServices() *gxset.HashSet {
 
 	var res = gxset.NewSet()
-	services, _, err := csd.consulClient.Catalog().Services(nil)
+	services, _, err := csd.client().Catalog().Services(nil)
 	if err != nil {
 		logger.Errorf("get services,error: %v", err)
 		return res
@@ -224,9 +439,21 @@ func (csd *consulServiceDiscovery) GetServices() *gxset.HashSet {
 }
 
 func (csd *consulServiceDiscovery) GetInstances(serviceName string) []registry.ServiceInstance {
+	if csd.applicationModeEnabled {
+		return csd.getApplicationInstances(serviceName)
+	}
+	return csd.getRawInstances(serviceName)
+}
+
+// getRawInstances fetches every healthy Consul service instance registered under serviceName,
+// without any application-level interface filtering.
+func (csd *consulServiceDiscovery) getRawInstances(serviceName string) []registry.ServiceInstance {
 	waitTime := csd.serviceUrl.GetParamInt(constant.WATCH_TIMEOUT, constant.DEFAULT_WATCH_TIMEOUT) / 1000
-	instances, _, err := csd.consulClient.Health().Service(serviceName, csd.tag, true, &consul.QueryOptions{
-		WaitTime: time.Duration(waitTime),
+	instances, _, err := csd.client().Health().Service(serviceName, csd.tag, true, &consul.QueryOptions{
+		WaitTime:  time.Duration(waitTime),
+		Token:     csd.getQueryToken(),
+		Namespace: csd.namespace,
+		Partition: csd.partition,
 	})
 	if err != nil {
 		logger.Errorf("get instances for service %s,error: %v", serviceName, err)
@@ -235,28 +462,7 @@ func (csd *consulServiceDiscovery) GetInstances(serviceName string) []registry.S
 
 	res := make([]registry.ServiceInstance, 0, len(instances))
 	for _, ins := range instances {
-		metadata := ins.Service.Meta
-
-		// enable status
-		enableStr := metadata[enable]
-		delete(metadata, enable)
-		enable, _ := strconv.ParseBool(enableStr)
-
-		// health status
-		status := ins.Checks.AggregatedStatus()
-		healthy := false
-		if status == consul.HealthPassing {
-			healthy = true
-		}
-		res = append(res, &registry.DefaultServiceInstance{
-			Id:          ins.Service.ID,
-			ServiceName: ins.Service.Service,
-			Host:        ins.Service.Address,
-			Port:        ins.Service.Port,
-			Enable:      enable,
-			Healthy:     healthy,
-			Metadata:    metadata,
-		})
+		res = append(res, csd.toServiceInstance(ins, ""))
 	}
 
 	return res
@@ -298,60 +504,37 @@ func (csd *consulServiceDiscovery) GetRequestInstances(serviceNames []string, of
 	return res
 }
 
+// AddListener subscribes listener to changes on listener.ServiceName. Multiple listeners on the same
+// service share a single serviceWatcher goroutine, which drives Consul's blocking-query long-poll
+// protocol instead of the fire-and-forget watch.Plan used previously.
 func (csd *consulServiceDiscovery) AddListener(listener *registry.ServiceInstancesChangedListener) error {
+	csd.watchersMu.Lock()
+	defer csd.watchersMu.Unlock()
 
-	params := make(map[string]interface{}, 8)
-	params["type"] = "service"
-	params["service"] = listener.ServiceName
-	params["passingonly"] = true
-	plan, err := watch.Parse(params)
-	if err != nil {
-		logger.Errorf("add listener for service %s,error:%v", listener.ServiceName, err)
-		return err
+	w, ok := csd.watchers[listener.ServiceName]
+	if !ok {
+		w = newServiceWatcher(csd, listener.ServiceName)
+		csd.watchers[listener.ServiceName] = w
+		go w.run()
 	}
+	w.addListener(listener)
+	return nil
+}
 
-	plan.Handler = func(idx uint64, raw interface{}) {
-		services, ok := raw.([]*consul.ServiceEntry)
-		if !ok {
-			err = perrors.New("handler get non ServiceEntry type parameter")
-			return
-		}
-		instances := make([]registry.ServiceInstance, 0, len(services))
-		for _, ins := range services {
-			metadata := ins.Service.Meta
-
-			// enable status
-			enableStr := metadata[enable]
-			delete(metadata, enable)
-			enable, _ := strconv.ParseBool(enableStr)
-
-			// health status
-			status := ins.Checks.AggregatedStatus()
-			healthy := false
-			if status == consul.HealthPassing {
-				healthy = true
-			}
-			instances = append(instances, &registry.DefaultServiceInstance{
-				Id:          ins.Service.ID,
-				ServiceName: ins.Service.Service,
-				Host:        ins.Service.Address,
-				Port:        ins.Service.Port,
-				Enable:      enable,
-				Healthy:     healthy,
-				Metadata:    metadata,
-			})
-		}
-		e := csd.DispatchEventForInstances(listener.ServiceName, instances)
-		if e != nil {
-			logger.Errorf("Dispatching event got exception, service name: %s, err: %v", listener.ServiceName, err)
-		}
+// RemoveListener unsubscribes listener. Once a service has no listeners left, its watcher goroutine
+// is stopped.
+func (csd *consulServiceDiscovery) RemoveListener(listener *registry.ServiceInstancesChangedListener) error {
+	csd.watchersMu.Lock()
+	defer csd.watchersMu.Unlock()
+
+	w, ok := csd.watchers[listener.ServiceName]
+	if !ok {
+		return nil
+	}
+	if w.removeListener(listener) {
+		delete(csd.watchers, listener.ServiceName)
+		w.stop()
 	}
-	go func() {
-		err = plan.RunWithConfig(csd.Config.Address, csd.Config)
-		if err != nil {
-			logger.Error("consul plan run failure!error:%v", err)
-		}
-	}()
 	return nil
 }
 
@@ -375,30 +558,160 @@ func (csd *consulServiceDiscovery) buildRegisterInstance(instance registry.Servi
 	}
 	metadata[enable] = strconv.FormatBool(instance.IsEnable())
 
-	// check
-	check := csd.buildCheck(instance)
+	// checks, built from whichever CheckStrategy was selected via check.type
+	checks := csd.checkStrategy.BuildChecks(csd, instance)
+
+	reg := &consul.AgentServiceRegistration{
+		ID:        buildID(instance),
+		Name:      instance.GetServiceName(),
+		Port:      instance.GetPort(),
+		Address:   instance.GetHost(),
+		Meta:      metadata,
+		Checks:    checks,
+		Token:     csd.getRegisterToken(),
+		Namespace: csd.namespace,
+		Partition: csd.partition,
+	}
 
-	return &consul.AgentServiceRegistration{
-		ID:      buildID(instance),
-		Name:    instance.GetServiceName(),
-		Port:    instance.GetPort(),
-		Address: instance.GetHost(),
-		Meta:    metadata,
-		Check:   &check,
-	}, nil
+	if csd.connectEnabled {
+		reg.Connect = csd.buildConnect(instance)
+		metadata[metaConnectNative] = strconv.FormatBool(csd.connectNative)
+	}
+
+	return reg, nil
 }
 
-func (csd *consulServiceDiscovery) buildCheck(instance registry.ServiceInstance) consul.AgentServiceCheck {
+// buildConnect builds the Connect block for an instance. When the instance is not marked as
+// Connect-native, a sidecar proxy registration is generated with upstreams derived from the
+// connectUpstreamsParam metadata entry, mirroring the "serviceName:localPort" pairs Consul expects.
+func (csd *consulServiceDiscovery) buildConnect(instance registry.ServiceInstance) *consul.AgentServiceConnect {
+	if csd.connectNative {
+		return &consul.AgentServiceConnect{Native: true}
+	}
+
+	sidecarPort := instance.GetPort() + 1
+	if p := instance.GetMetadata()[connectSidecarPortParam]; p != "" {
+		if parsed, err := strconv.Atoi(p); err == nil {
+			sidecarPort = parsed
+		}
+	}
+
+	upstreams := buildUpstreams(instance.GetMetadata()[connectUpstreamsParam])
+
+	return &consul.AgentServiceConnect{
+		SidecarService: &consul.AgentServiceRegistration{
+			Port: sidecarPort,
+			Proxy: &consul.AgentServiceConnectProxyConfig{
+				Upstreams: upstreams,
+			},
+		},
+	}
+}
 
+// buildUpstreams parses a "serviceName:localPort,serviceName:localPort" metadata value into the
+// Upstream list the sidecar proxy should dial out to.
+func buildUpstreams(raw string) []consul.Upstream {
+	if raw == "" {
+		return nil
+	}
+	parts := strings.Split(raw, ",")
+	upstreams := make([]consul.Upstream, 0, len(parts))
+	for _, p := range parts {
+		nameAndPort := strings.SplitN(p, ":", 2)
+		if len(nameAndPort) != 2 {
+			logger.Warnf("ignore malformed connect upstream %s, expect serviceName:localPort", p)
+			continue
+		}
+		localPort, err := strconv.Atoi(nameAndPort[1])
+		if err != nil {
+			logger.Warnf("ignore malformed connect upstream %s, port must be an integer", p)
+			continue
+		}
+		upstreams = append(upstreams, consul.Upstream{
+			DestinationName: nameAndPort[0],
+			LocalBindPort:   localPort,
+		})
+	}
+	return upstreams
+}
+
+// GetConnectInstances returns only the Connect-enabled endpoints for serviceName, i.e. the sidecar
+// proxies (or Connect-native instances) fronting it, so callers can establish mTLS connections
+// without going through an external service mesh proxy.
+func (csd *consulServiceDiscovery) GetConnectInstances(serviceName string) []registry.ServiceInstance {
+	waitTime := time.Duration(csd.serviceUrl.GetParamInt(constant.WATCH_TIMEOUT, constant.DEFAULT_WATCH_TIMEOUT)) * time.Millisecond
+	services, _, err := csd.client().Health().Connect(serviceName, csd.tag, true, &consul.QueryOptions{
+		WaitTime:  waitTime,
+		Token:     csd.getQueryToken(),
+		Namespace: csd.namespace,
+		Partition: csd.partition,
+	})
+	if err != nil {
+		logger.Errorf("get connect instances for service %s,error: %v", serviceName, err)
+		return nil
+	}
+
+	caRoots := csd.connectCARootsMeta()
+
+	res := make([]registry.ServiceInstance, 0, len(services))
+	for _, ins := range services {
+		res = append(res, csd.toServiceInstance(ins, caRoots))
+	}
+	return res
+}
+
+// connectCARootsMeta fetches the Connect CA roots and serialises their IDs so that upper layers can
+// recognise which trust domain an instance belongs to without a separate round trip.
+func (csd *consulServiceDiscovery) connectCARootsMeta() string {
+	roots, _, err := csd.client().Agent().ConnectCARoots(nil)
+	if err != nil {
+		logger.Debugf("get connect ca roots failed, mTLS metadata will be empty:%v", err)
+		return ""
+	}
+	ids := make([]string, 0, len(roots.Roots))
+	for _, root := range roots.Roots {
+		ids = append(ids, root.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+// toServiceInstance converts a consul.ServiceEntry into a registry.DefaultServiceInstance, stamping
+// the Connect CA metadata onto it when it is non-empty.
+func (csd *consulServiceDiscovery) toServiceInstance(ins *consul.ServiceEntry, caRoots string) registry.ServiceInstance {
+	metadata := ins.Service.Meta
+
+	// enable status
+	enableStr := metadata[enable]
+	delete(metadata, enable)
+	instanceEnable, _ := strconv.ParseBool(enableStr)
+
+	// health status
+	status := ins.Checks.AggregatedStatus()
+	healthy := status == consul.HealthPassing
+
+	if caRoots != "" {
+		metadata[metaConnectCARoots] = caRoots
+	}
+
+	return &registry.DefaultServiceInstance{
+		Id:          ins.Service.ID,
+		ServiceName: ins.Service.Service,
+		Host:        ins.Service.Address,
+		Port:        ins.Service.Port,
+		Enable:      instanceEnable,
+		Healthy:     healthy,
+		Metadata:    metadata,
+	}
+}
+
+// buildDeregisterAfter resolves the DeregisterCriticalServiceAfter value shared by every check
+// strategy: an explicit per-instance override, falling back to the discovery-wide default.
+func buildDeregisterAfter(instance registry.ServiceInstance) string {
 	deregister, ok := instance.GetMetadata()[constant.DEREGISTER_AFTER]
 	if !ok || deregister == "" {
 		deregister = constant.DEFAULT_DEREGISTER_TIME
 	}
-	return consul.AgentServiceCheck{
-		CheckID:                        buildID(instance),
-		TTL:                            strconv.FormatInt(csd.checkPassInterval/1000, 10) + "s",
-		DeregisterCriticalServiceAfter: deregister,
-	}
+	return deregister
 }
 
 func buildID(instance registry.ServiceInstance) string {
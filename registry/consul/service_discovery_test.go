@@ -0,0 +1,210 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+import (
+	"github.com/apache/dubbo-go/common"
+	"github.com/apache/dubbo-go/common/constant"
+	"github.com/apache/dubbo-go/registry"
+)
+
+// newTestServiceDiscovery spins up an in-process Consul test agent and returns a
+// consulServiceDiscovery initialized against it, with a fast TTL so the heartbeat goroutines churn
+// during the test instead of sitting idle.
+func newTestServiceDiscovery(t *testing.T) (*consulServiceDiscovery, func()) {
+	server, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+
+	csd := &consulServiceDiscovery{
+		address:            server.HTTPAddr,
+		descriptor:         "consul-service-discovery[test]",
+		ttl:                make(map[string]context.CancelFunc),
+		watchers:           make(map[string]*serviceWatcher),
+		exportedInterfaces: make(map[string]map[string]registry.ServiceInstance),
+		revisionCache:      make(map[string]*MetadataInfo),
+	}
+	registryURL := common.NewURLWithOptions(
+		common.WithParams(map[string][]string{"checkPassInterval": {"80"}}),
+	)
+	require.NoError(t, csd.Init(registryURL))
+
+	return csd, func() {
+		_ = csd.Destroy()
+		server.Stop()
+	}
+}
+
+// TestConcurrentRegisterUnregisterStress hammers Register/Unregister from many goroutines at once,
+// the way a real application registering hundreds of interfaces under load would, to guard against
+// the data races the unprotected ttl map and non-idempotent Unregister previously allowed.
+func TestConcurrentRegisterUnregisterStress(t *testing.T) {
+	csd, closeFn := newTestServiceDiscovery(t)
+	defer closeFn()
+
+	const instanceCount = 200
+
+	var wg sync.WaitGroup
+	wg.Add(instanceCount)
+	for i := 0; i < instanceCount; i++ {
+		i := i
+		go func() {
+			defer wg.Done()
+			instance := &registry.DefaultServiceInstance{
+				Id:          fmt.Sprintf("stress-%d", i),
+				ServiceName: "stress-service",
+				Host:        "127.0.0.1",
+				Port:        10000 + i,
+				Enable:      true,
+				Healthy:     true,
+			}
+			assert.NoError(t, csd.Register(instance))
+			// Unregister twice to exercise idempotency under concurrency.
+			assert.NoError(t, csd.Unregister(instance))
+			assert.NoError(t, csd.Unregister(instance))
+		}()
+	}
+	wg.Wait()
+}
+
+// TestUnregisterConcurrentWithDestroy exercises Unregister racing Destroy, which previously could
+// write to (or close a channel in) a map that Destroy had already nilled out from under it.
+func TestUnregisterConcurrentWithDestroy(t *testing.T) {
+	csd, closeFn := newTestServiceDiscovery(t)
+	defer func() {
+		// Destroy is called by the test itself below; closeFn just stops the test server.
+		closeFn()
+	}()
+
+	const instanceCount = 100
+	instances := make([]*registry.DefaultServiceInstance, instanceCount)
+	for i := range instances {
+		instances[i] = &registry.DefaultServiceInstance{
+			Id:          fmt.Sprintf("destroy-race-%d", i),
+			ServiceName: "destroy-race-service",
+			Host:        "127.0.0.1",
+			Port:        20000 + i,
+			Enable:      true,
+			Healthy:     true,
+		}
+		require.NoError(t, csd.Register(instances[i]))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(instanceCount + 1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(time.Millisecond)
+		assert.NoError(t, csd.Destroy())
+	}()
+	for _, instance := range instances {
+		instance := instance
+		go func() {
+			defer wg.Done()
+			_ = csd.Unregister(instance)
+		}()
+	}
+	wg.Wait()
+}
+
+// newTestApplicationServiceDiscovery is newTestServiceDiscovery with application-mode enabled, so
+// Register/Update/Unregister exercise the application-level (one Consul service per app, many
+// interfaces per instance) path instead of the default one-Consul-service-per-interface path.
+func newTestApplicationServiceDiscovery(t *testing.T) (*consulServiceDiscovery, func()) {
+	server, err := testutil.NewTestServerConfigT(t, nil)
+	require.NoError(t, err)
+
+	csd := &consulServiceDiscovery{
+		address:            server.HTTPAddr,
+		descriptor:         "consul-service-discovery[test]",
+		ttl:                make(map[string]context.CancelFunc),
+		watchers:           make(map[string]*serviceWatcher),
+		exportedInterfaces: make(map[string]map[string]registry.ServiceInstance),
+		revisionCache:      make(map[string]*MetadataInfo),
+	}
+	registryURL := common.NewURLWithOptions(
+		common.WithParams(map[string][]string{
+			"checkPassInterval":      {"80"},
+			applicationModeParam:     {"true"},
+			constant.APPLICATION_KEY: {"test-app"},
+		}),
+	)
+	require.NoError(t, csd.Init(registryURL))
+
+	return csd, func() {
+		_ = csd.Destroy()
+		server.Stop()
+	}
+}
+
+// TestUnregisterApplicationInstanceDropsOnlyRemovedInterface registers two interfaces on the same
+// host:port (application-mode folds both into a single Consul service instance), unregisters one, and
+// asserts GetInstances for the removed interface no longer returns the instance while GetInstances for
+// the interface that's still exported does. This checks that unregisterApplicationInstance
+// recomputes the revision from the shrunk interface set instead of accidentally re-adding the
+// interface it just dropped.
+func TestUnregisterApplicationInstanceDropsOnlyRemovedInterface(t *testing.T) {
+	csd, closeFn := newTestApplicationServiceDiscovery(t)
+	defer closeFn()
+
+	kept := &registry.DefaultServiceInstance{
+		Id:          "kept-interface",
+		ServiceName: "kept-interface",
+		Host:        "127.0.0.1",
+		Port:        30000,
+		Enable:      true,
+		Healthy:     true,
+	}
+	removed := &registry.DefaultServiceInstance{
+		Id:          "removed-interface",
+		ServiceName: "removed-interface",
+		Host:        "127.0.0.1",
+		Port:        30000,
+		Enable:      true,
+		Healthy:     true,
+	}
+
+	require.NoError(t, csd.Register(kept))
+	require.NoError(t, csd.Register(removed))
+	require.NoError(t, csd.Unregister(removed))
+
+	assert.Empty(t, csd.GetInstances("removed-interface"))
+	assert.NotEmpty(t, csd.GetInstances("kept-interface"))
+}
+
+// TestDefaultCheckStrategyIsTtl is a sanity check that the TTL strategy is still the Register
+// default, guarding against an accidental regression in newCheckStrategy's fallback.
+func TestDefaultCheckStrategyIsTtl(t *testing.T) {
+	registryURL := common.NewURLWithOptions()
+	strategy := newCheckStrategy(registryURL)
+	assert.Equal(t, checkTypeTTL, strategy.Name())
+	assert.True(t, strategy.RequiresHeartbeat())
+}
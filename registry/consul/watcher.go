@@ -0,0 +1,225 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consul
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+import (
+	consul "github.com/hashicorp/consul/api"
+)
+
+import (
+	"github.com/apache/dubbo-go/common/constant"
+	"github.com/apache/dubbo-go/common/logger"
+	"github.com/apache/dubbo-go/registry"
+)
+
+const (
+	// watchMinBackoff/watchMaxBackoff bound the exponential backoff applied between failed blocking
+	// queries, so a flapping Consul agent doesn't turn into a tight error loop.
+	watchMinBackoff = time.Second
+	watchMaxBackoff = time.Minute
+)
+
+// serviceWatcher drives a single Consul blocking query for one service name and, whenever the
+// instance set changes, dispatches the refreshed list as one registry.ServiceInstancesChangedEvent
+// through the global event dispatcher (see diffAndDispatch); it does not call its listeners directly,
+// and listeners is only used to stop the watcher once the last one is removed.
+// Only one serviceWatcher goroutine ever runs per service name, regardless of how many listeners
+// are attached, so N subscribers cost one long-poll instead of N.
+type serviceWatcher struct {
+	csd         *consulServiceDiscovery
+	serviceName string
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	mu        sync.Mutex
+	listeners map[*registry.ServiceInstancesChangedListener]struct{}
+	// known is the last seen instance set, keyed by instance id, used to diff incoming responses.
+	known map[string]registry.ServiceInstance
+}
+
+func newServiceWatcher(csd *consulServiceDiscovery, serviceName string) *serviceWatcher {
+	ctx, cancel := context.WithCancel(csd.rootCtx)
+	return &serviceWatcher{
+		csd:         csd,
+		serviceName: serviceName,
+		ctx:         ctx,
+		cancel:      cancel,
+		listeners:   make(map[*registry.ServiceInstancesChangedListener]struct{}),
+		known:       make(map[string]registry.ServiceInstance),
+	}
+}
+
+func (w *serviceWatcher) addListener(listener *registry.ServiceInstancesChangedListener) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.listeners[listener] = struct{}{}
+}
+
+// removeListener reports whether this was the last listener, so the caller can tear the watcher down.
+func (w *serviceWatcher) removeListener(listener *registry.ServiceInstancesChangedListener) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.listeners, listener)
+	return len(w.listeners) == 0
+}
+
+func (w *serviceWatcher) stop() {
+	w.cancel()
+}
+
+// run executes the blocking-query long-poll loop until its context is canceled. Each iteration waits
+// up to the constant.WATCH_TIMEOUT URL param (constant.DEFAULT_WATCH_TIMEOUT when unset) for Consul
+// to return either new data or a timeout, tracks the
+// returned X-Consul-Index so the next call blocks until something actually changes, and diffs the
+// result against the previously known instance set to emit granular events.
+func (w *serviceWatcher) run() {
+	var (
+		waitIndex uint64
+		backoff   = watchMinBackoff
+	)
+
+	waitTime := time.Duration(w.csd.serviceUrl.GetParamInt(constant.WATCH_TIMEOUT, constant.DEFAULT_WATCH_TIMEOUT)) * time.Millisecond
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		default:
+		}
+
+		queryOpts := (&consul.QueryOptions{
+			WaitIndex: waitIndex,
+			WaitTime:  waitTime,
+			Token:     w.csd.getWatchToken(),
+			Namespace: w.csd.namespace,
+			Partition: w.csd.partition,
+		}).WithContext(w.ctx)
+		services, meta, err := w.csd.client().Health().Service(w.serviceName, w.csd.tag, true, queryOpts)
+		if err != nil {
+			if w.ctx.Err() != nil {
+				return
+			}
+			logger.Warnf("consul blocking query for service %s failed, retry in %s: %v", w.serviceName, backoff, err)
+			if !sleepOrDone(w.ctx, backoff) {
+				return
+			}
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		backoff = watchMinBackoff
+
+		// Consul's index can go backward after a leader election or catalog restore; restart from 0.
+		if meta.LastIndex < waitIndex {
+			waitIndex = 0
+		} else {
+			waitIndex = meta.LastIndex
+		}
+
+		w.diffAndDispatch(services)
+	}
+}
+
+// diffAndDispatch compares the freshly polled instance set against w.known and dispatches the
+// refreshed instance list only when something actually changed instead of unconditionally firing on
+// every long-poll return. Per-instance added/removed/updated transitions are logged individually so
+// operators can see the fine-grained diff, but registry.ServiceInstancesChangedEvent is the only event
+// type this SPI defines — there is no typed added/removed/updated variant to dispatch per change, so
+// a single bulk event is what consumers actually receive.
+func (w *serviceWatcher) diffAndDispatch(services []*consul.ServiceEntry) {
+	current := make(map[string]registry.ServiceInstance, len(services))
+	all := make([]registry.ServiceInstance, 0, len(services))
+	for _, ins := range services {
+		instance := w.csd.toServiceInstance(ins, "")
+		current[instance.GetId()] = instance
+		all = append(all, instance)
+	}
+
+	w.mu.Lock()
+	previous := w.known
+	w.known = current
+	w.mu.Unlock()
+
+	changed := false
+	for id, instance := range current {
+		old, existed := previous[id]
+		switch {
+		case !existed:
+			logger.Infof("service %s: instance %s added", w.serviceName, instance.GetId())
+			changed = true
+		case !instanceEqual(old, instance):
+			logger.Infof("service %s: instance %s updated", w.serviceName, instance.GetId())
+			changed = true
+		}
+	}
+	for id, instance := range previous {
+		if _, stillPresent := current[id]; !stillPresent {
+			logger.Infof("service %s: instance %s removed", w.serviceName, instance.GetId())
+			changed = true
+		}
+	}
+
+	if !changed {
+		return
+	}
+	if err := w.csd.DispatchEventForInstances(w.serviceName, all); err != nil {
+		logger.Errorf("dispatching event for service %s failed: %v", w.serviceName, err)
+	}
+}
+
+// instanceEqual compares the fields that matter to consumers: address, health and metadata.
+func instanceEqual(a, b registry.ServiceInstance) bool {
+	if a.GetHost() != b.GetHost() || a.GetPort() != b.GetPort() || a.IsHealthy() != b.IsHealthy() || a.IsEnable() != b.IsEnable() {
+		return false
+	}
+	am, bm := a.GetMetadata(), b.GetMetadata()
+	if len(am) != len(bm) {
+		return false
+	}
+	for k, v := range am {
+		if bm[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// sleepOrDone sleeps for d unless ctx is canceled first, reporting whether the sleep completed.
+func sleepOrDone(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func nextBackoff(current time.Duration) time.Duration {
+	next := current * 2
+	if next > watchMaxBackoff {
+		return watchMaxBackoff
+	}
+	return next
+}